@@ -3,28 +3,342 @@ package utils
 import (
 	"compress/bzip2"
 	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cheggaaa/pb/v3"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
 )
 
 // Downloader is parallel HTTP fetcher
 type Downloader interface {
 	Download(url string, destination string, result chan<- error)
 	DownloadWithChecksum(url string, destination string, result chan<- error, expected ChecksumInfo)
+	DownloadWithProgress(url string, destination string, result chan<- error, expected ChecksumInfo, tracker ProgressTracker)
 	Pause()
 	Resume()
 	Shutdown()
 }
 
+// ProgressTracker receives progress notifications for downloads processed by
+// a Downloader.
+type ProgressTracker interface {
+	// Start is called once a download begins; total is the size of the
+	// whole resource in bytes (for a resumed transfer, the response's
+	// Content-Length plus the bytes already on disk), or -1 if it isn't
+	// known up front.
+	Start(url string, total int64)
+	// Write is called after each chunk read from the response body, with
+	// the number of bytes read.
+	Write(n int)
+	// Reset sets the number of bytes counted so far back to current,
+	// discarding any progress credited by a prior attempt that has been
+	// abandoned -- e.g. a retry that had to restart the transfer from
+	// byte zero after a partial read, or the bytes a resumed transfer
+	// already has on disk. It has no effect before Start or after Done.
+	Reset(current int64)
+	// Done is called exactly once per download, on every exit path, with
+	// the resulting error (nil on success).
+	Done(url string, err error)
+}
+
+// noopProgressTracker is the default ProgressTracker: it reports nothing,
+// preserving the original silent behavior.
+type noopProgressTracker struct{}
+
+func (noopProgressTracker) Start(string, int64) {}
+func (noopProgressTracker) Write(int)           {}
+func (noopProgressTracker) Reset(int64)         {}
+func (noopProgressTracker) Done(string, error)  {}
+
+// NoopProgressTracker is a ProgressTracker that discards every event.
+var NoopProgressTracker ProgressTracker = noopProgressTracker{}
+
+// BarProgressTracker renders a terminal progress bar, for use by interactive
+// commands such as `aptly mirror update`. It is not meant to be shared by
+// more than one download at a time.
+type BarProgressTracker struct {
+	mu      sync.Mutex
+	current *pb.ProgressBar
+}
+
+// NewBarProgressTracker creates a BarProgressTracker.
+func NewBarProgressTracker() *BarProgressTracker {
+	return &BarProgressTracker{}
+}
+
+// Start implements ProgressTracker.
+func (t *BarProgressTracker) Start(url string, total int64) {
+	bar := pb.Full.Start64(total)
+	bar.Set("prefix", filepath.Base(url)+" ")
+
+	t.mu.Lock()
+	t.current = bar
+	t.mu.Unlock()
+}
+
+// Write implements ProgressTracker.
+func (t *BarProgressTracker) Write(n int) {
+	t.mu.Lock()
+	bar := t.current
+	t.mu.Unlock()
+
+	if bar != nil {
+		bar.Add(n)
+	}
+}
+
+// Reset implements ProgressTracker.
+func (t *BarProgressTracker) Reset(current int64) {
+	t.mu.Lock()
+	bar := t.current
+	t.mu.Unlock()
+
+	if bar != nil {
+		bar.SetCurrent(current)
+	}
+}
+
+// Done implements ProgressTracker.
+func (t *BarProgressTracker) Done(_ string, _ error) {
+	t.mu.Lock()
+	bar := t.current
+	t.current = nil
+	t.mu.Unlock()
+
+	if bar != nil {
+		bar.Finish()
+	}
+}
+
+// progressReader wraps a reader, reporting every Read to a ProgressTracker.
+type progressReader struct {
+	io.Reader
+	tracker ProgressTracker
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.tracker.Write(n)
+	}
+	return n, err
+}
+
 // Check interface
 var (
 	_ Downloader = &downloaderImpl{}
 )
 
+// DownloaderOptions controls optional behavior of a Downloader
+type DownloaderOptions struct {
+	// DisableResume disables resuming of partially downloaded files from a previous run
+	DisableResume bool
+}
+
+// RetryPolicy configures the exponential backoff used to retry transient
+// download failures. A zero MaxRetries disables retrying.
+type RetryPolicy struct {
+	MaxRetries      int
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+}
+
+// HTTPStatusError reports a non-2xx HTTP response, preserving the status
+// code (and the server's requested Retry-After, if it sent one) so that the retry
+// policy can tell a transient failure from a permanent one.
+type HTTPStatusError struct {
+	StatusCode int
+	RetryAfter time.Duration
+	URL        string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("HTTP code %d while fetching %s", e.StatusCode, e.URL)
+}
+
+// parseRetryAfter parses the Retry-After header, which is either a number
+// of seconds or an HTTP date. Unparseable or absent values yield zero.
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if when, err := http.ParseTime(header); err == nil {
+		if d := time.Until(when); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
+
+// SchemeDownloader fetches the content behind a URL for a particular scheme
+// (http, file, data, ...). Registering one for a custom scheme lets callers
+// teach Downloader about backends (FTP, S3, ...) without touching the
+// queue/worker plumbing.
+type SchemeDownloader interface {
+	// Fetch opens url and returns a reader for its content together with the
+	// total size in bytes, or -1 if the size isn't known up front.
+	Fetch(ctx context.Context, url string) (io.ReadCloser, int64, error)
+}
+
+// RangeSchemeDownloader is an optional extension of SchemeDownloader for
+// backends that can resume a transfer starting at a given byte offset.
+type RangeSchemeDownloader interface {
+	SchemeDownloader
+
+	// FetchRange is like Fetch, but asks the backend to start the transfer
+	// offset bytes into the resource. resumed reports whether the backend
+	// honored the offset; if false, the returned reader starts from byte 0
+	// and the caller must treat it like a regular Fetch.
+	FetchRange(ctx context.Context, url string, offset int64) (reader io.ReadCloser, size int64, resumed bool, err error)
+}
+
+// defaultSchemeDownloaders returns the built-in set of SchemeDownloaders
+// registered by NewDownloader when the caller doesn't supply its own.
+func defaultSchemeDownloaders() map[string]SchemeDownloader {
+	return map[string]SchemeDownloader{
+		"http":  httpSchemeDownloader{},
+		"https": httpSchemeDownloader{},
+		"file":  fileSchemeDownloader{},
+		"data":  dataSchemeDownloader{},
+	}
+}
+
+// httpSchemeDownloader fetches http:// and https:// URLs, and is the only
+// built-in downloader that supports resuming via HTTP Range requests.
+type httpSchemeDownloader struct{}
+
+func (httpSchemeDownloader) Fetch(ctx context.Context, rawurl string) (io.ReadCloser, int64, error) {
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return nil, -1, err
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, -1, &HTTPStatusError{StatusCode: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")), URL: rawurl}
+	}
+
+	return resp.Body, resp.ContentLength, nil
+}
+
+func (d httpSchemeDownloader) FetchRange(ctx context.Context, rawurl string, offset int64) (io.ReadCloser, int64, bool, error) {
+	if offset <= 0 {
+		reader, size, err := d.Fetch(ctx, rawurl)
+		return reader, size, false, err
+	}
+
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return nil, -1, false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, -1, false, err
+	}
+
+	if resp.StatusCode == http.StatusPartialContent {
+		return resp.Body, resp.ContentLength, true, nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, -1, false, &HTTPStatusError{StatusCode: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")), URL: rawurl}
+	}
+
+	// server ignored the Range header and sent the whole body back
+	return resp.Body, resp.ContentLength, false, nil
+}
+
+// fileSchemeDownloader serves file:// URLs by copying from the local
+// filesystem instead of going out over the network.
+type fileSchemeDownloader struct{}
+
+func (fileSchemeDownloader) Fetch(_ context.Context, rawurl string) (io.ReadCloser, int64, error) {
+	parsed, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	file, err := os.Open(parsed.Path)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, -1, err
+	}
+
+	return file, fi.Size(), nil
+}
+
+// dataSchemeDownloader decodes RFC 2397 data: URLs, e.g.
+// "data:text/plain;base64,aGVsbG8=".
+type dataSchemeDownloader struct{}
+
+func (dataSchemeDownloader) Fetch(_ context.Context, rawurl string) (io.ReadCloser, int64, error) {
+	payload := strings.TrimPrefix(rawurl, "data:")
+
+	comma := strings.IndexByte(payload, ',')
+	if comma == -1 {
+		return nil, -1, fmt.Errorf("malformed data URL: %s", rawurl)
+	}
+
+	meta, data := payload[:comma], payload[comma+1:]
+
+	var decoded []byte
+	var err error
+
+	if strings.HasSuffix(meta, ";base64") {
+		decoded, err = base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, -1, err
+		}
+	} else {
+		unescaped, err := url.PathUnescape(data)
+		if err != nil {
+			return nil, -1, err
+		}
+		decoded = []byte(unescaped)
+	}
+
+	return ioutil.NopCloser(strings.NewReader(string(decoded))), int64(len(decoded)), nil
+}
+
 // downloaderImpl is implementation of Downloader interface
 type downloaderImpl struct {
 	queue   chan *downloadTask
@@ -33,6 +347,27 @@ type downloaderImpl struct {
 	pause   chan bool
 	unpause chan bool
 	threads int
+	options DownloaderOptions
+	schemes map[string]SchemeDownloader
+	retry   RetryPolicy
+	tracker ProgressTracker
+
+	// inflight maps a destination path to the inflightDownload currently
+	// writing it, so that concurrent requests for the same destination
+	// share one download instead of racing each other.
+	inflight sync.Map
+}
+
+// inflightDownload is the shared result of a download in progress, handed
+// out to every caller that asks for the same destination while it runs.
+// url and expected identify what it's actually downloading, so a second
+// caller asking for a different source can be told its destination is
+// busy instead of silently being handed an unrelated result.
+type inflightDownload struct {
+	url      string
+	expected ChecksumInfo
+	done     chan struct{}
+	err      error
 }
 
 // downloadTask represents single item in queue
@@ -41,11 +376,45 @@ type downloadTask struct {
 	destination string
 	result      chan<- error
 	expected    ChecksumInfo
+	tracker     ProgressTracker
+}
+
+// errCorruptResume is returned internally when a resumed download fails
+// checksum/size verification, signalling that it should be retried from scratch
+var errCorruptResume = errors.New("resumed download failed verification")
+
+// NewDownloader creates new instance of Downloader with specified number of
+// threads. schemes registers the SchemeDownloader used for each URL scheme;
+// pass nil to use the built-in http, https, file and data handlers.
+func NewDownloader(threads int, schemes map[string]SchemeDownloader) Downloader {
+	return NewDownloaderWithOptions(threads, schemes, DownloaderOptions{})
 }
 
-// NewDownloader creates new instance of Downloader which specified number
-// of threads
-func NewDownloader(threads int) Downloader {
+// NewDownloaderWithOptions creates new instance of Downloader with specified
+// number of threads, scheme handlers and options controlling its behavior.
+func NewDownloaderWithOptions(threads int, schemes map[string]SchemeDownloader, opts DownloaderOptions) Downloader {
+	return NewDownloaderWithRetry(threads, schemes, opts, RetryPolicy{})
+}
+
+// NewDownloaderWithRetry creates new instance of Downloader that retries
+// transient failures (network errors, HTTP 5xx, HTTP 429) according to
+// policy, waiting with exponential backoff between attempts.
+func NewDownloaderWithRetry(threads int, schemes map[string]SchemeDownloader, opts DownloaderOptions, policy RetryPolicy) Downloader {
+	return NewDownloaderWithProgress(threads, schemes, opts, policy, NoopProgressTracker)
+}
+
+// NewDownloaderWithProgress creates new instance of Downloader that reports
+// progress for every download to tracker (use NoopProgressTracker, the
+// default, to keep the original silent behavior).
+func NewDownloaderWithProgress(threads int, schemes map[string]SchemeDownloader, opts DownloaderOptions, policy RetryPolicy, tracker ProgressTracker) Downloader {
+	if schemes == nil {
+		schemes = defaultSchemeDownloaders()
+	}
+
+	if tracker == nil {
+		tracker = NoopProgressTracker
+	}
+
 	downloader := &downloaderImpl{
 		queue:   make(chan *downloadTask, 1000),
 		stop:    make(chan bool),
@@ -53,6 +422,10 @@ func NewDownloader(threads int) Downloader {
 		pause:   make(chan bool),
 		unpause: make(chan bool),
 		threads: threads,
+		options: opts,
+		schemes: schemes,
+		retry:   policy,
+		tracker: tracker,
 	}
 
 	for i := 0; i < downloader.threads; i++ {
@@ -95,55 +468,303 @@ func (downloader *downloaderImpl) Download(url string, destination string, resul
 
 // DownloadWithChecksum starts new download task with checksum verification
 func (downloader *downloaderImpl) DownloadWithChecksum(url string, destination string, result chan<- error, expected ChecksumInfo) {
-	downloader.queue <- &downloadTask{url: url, destination: destination, result: result, expected: expected}
+	downloader.queue <- &downloadTask{url: url, destination: destination, result: result, expected: expected, tracker: downloader.tracker}
 }
 
-// handleTask processes single download task
+// DownloadWithProgress starts new download task with checksum verification,
+// reporting progress to tracker instead of the Downloader's default tracker
+func (downloader *downloaderImpl) DownloadWithProgress(url string, destination string, result chan<- error, expected ChecksumInfo, tracker ProgressTracker) {
+	if tracker == nil {
+		tracker = NoopProgressTracker
+	}
+
+	downloader.queue <- &downloadTask{url: url, destination: destination, result: result, expected: expected, tracker: tracker}
+}
+
+// handleTask processes single download task, making sure that at most one
+// download is ever in flight for a given destination at a time
 func (downloader *downloaderImpl) handleTask(task *downloadTask) {
+	leader := &inflightDownload{url: task.url, expected: task.expected, done: make(chan struct{})}
+
+	actual, alreadyRunning := downloader.inflight.LoadOrStore(task.destination, leader)
+	if alreadyRunning {
+		current := actual.(*inflightDownload)
+		if current.url != task.url || current.expected != task.expected {
+			task.result <- fmt.Errorf("%s: already being downloaded from %s, refusing to share its result with a request for %s", task.destination, current.url, task.url)
+			return
+		}
+
+		<-current.done
+		task.result <- current.err
+		return
+	}
+
 	fmt.Printf("Downloading %s...\n", task.url)
 
-	resp, err := http.Get(task.url)
+	leader.err = downloader.fetchWithRetry(task)
+	downloader.inflight.Delete(task.destination)
+	close(leader.done)
+
+	task.result <- leader.err
+}
+
+// fetchWithRetry calls fetch, retrying transient failures with exponential
+// backoff according to downloader.retry. task.tracker.Done is invoked
+// exactly once here, for the task as a whole, and task.tracker.Start at
+// most once (by the first attempt that opens the source), regardless of
+// how many attempts fetch needs underneath.
+func (downloader *downloaderImpl) fetchWithRetry(task *downloadTask) (err error) {
+	defer func() { task.tracker.Done(task.url, err) }()
+
+	started := false
+
+	for attempt := 0; ; attempt++ {
+		err = downloader.fetch(task, &started)
+
+		if err == errCorruptResume {
+			fmt.Printf("Resumed download of %s didn't verify, restarting from scratch...\n", task.url)
+			err = downloader.fetch(task, &started)
+		}
+
+		if err == nil || attempt >= downloader.retry.MaxRetries || !isRetryable(err) {
+			return err
+		}
+
+		wait := retryAfter(err)
+		if wait == 0 {
+			wait = backoffInterval(downloader.retry, attempt)
+		}
+
+		fmt.Printf("Retrying %s in %s (attempt %d/%d) after: %s\n", task.url, wait, attempt+1, downloader.retry.MaxRetries, err)
+		time.Sleep(wait)
+	}
+}
+
+// isRetryable reports whether err represents a failure worth retrying:
+// temporary/timeout network errors, HTTP 5xx and HTTP 429. Other HTTP 4xx
+// statuses are treated as permanent.
+func isRetryable(err error) bool {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return netErr.Temporary() || netErr.Timeout()
+	}
+
+	return false
+}
+
+// retryAfter extracts the server-requested delay (Retry-After) from an HTTP
+// error response, if any.
+func retryAfter(err error) time.Duration {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.RetryAfter
+	}
+
+	return 0
+}
+
+// backoffInterval computes the exponential backoff delay for attempt
+// (0-indexed), capped at policy.MaxInterval and with up to 20% jitter added.
+func backoffInterval(policy RetryPolicy, attempt int) time.Duration {
+	interval := policy.InitialInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	multiplier := policy.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+
+	delay := float64(interval)
+	for i := 0; i < attempt; i++ {
+		delay *= multiplier
+	}
+
+	if policy.MaxInterval > 0 && delay > float64(policy.MaxInterval) {
+		delay = float64(policy.MaxInterval)
+	}
+
+	jitter := delay * 0.2 * rand.Float64()
+
+	return time.Duration(delay + jitter)
+}
+
+// removeStaleParts deletes any leftover *.part temp files for destination
+// left behind by a previous, resume-disabled attempt that was killed
+// before it could clean up after itself.
+func removeStaleParts(destination string) {
+	matches, err := filepath.Glob(destination + ".*.part")
 	if err != nil {
-		task.result <- err
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		task.result <- fmt.Errorf("HTTP code %d while fetching %s", resp.StatusCode, task.url)
-		return
+	for _, match := range matches {
+		os.Remove(match)
+	}
+}
+
+// fetch performs a single download attempt, resuming from an existing
+// .down file when possible, and writes the result to task.destination.
+// started records whether task.tracker.Start has been called for this
+// task: the first attempt that opens the source calls Start and sets it,
+// and later attempts reuse the tracker that attempt started.
+func (downloader *downloaderImpl) fetch(task *downloadTask, started *bool) (err error) {
+	parsed, err := url.Parse(task.url)
+	if err != nil {
+		return err
 	}
 
+	scheme, ok := downloader.schemes[parsed.Scheme]
+	if !ok {
+		return fmt.Errorf("no downloader registered for scheme %q (%s)", parsed.Scheme, task.url)
+	}
+
+	// resumePath is the stable, predictable name a partial download is left
+	// under so that it can be found and resumed on a later run. Resuming
+	// only reuses it when task carries a checksum to verify the finished
+	// file against: without one there's no way to tell a genuine partial
+	// from a torn or stale file left by a killed run, or from a resource
+	// that has since changed server-side, so any leftover is discarded
+	// and the download starts over from scratch.
+	resumePath := task.destination + ".down"
+
+	var startSize int64
+
+	if !downloader.options.DisableResume {
+		if task.expected.Size != -1 {
+			if fi, statErr := os.Stat(resumePath); statErr == nil && fi.Size() > 0 {
+				startSize = fi.Size()
+			}
+		} else {
+			os.Remove(resumePath)
+		}
+	}
+
+	ctx := context.Background()
+
+	var (
+		body     io.ReadCloser
+		size     int64
+		resuming bool
+	)
+
+	if rangeScheme, ok := scheme.(RangeSchemeDownloader); ok && startSize > 0 {
+		body, size, resuming, err = rangeScheme.FetchRange(ctx, task.url, startSize)
+	} else {
+		body, size, err = scheme.Fetch(ctx, task.url)
+	}
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if startSize > 0 && !resuming {
+		// backend couldn't resume, fall back to a full download
+		os.Remove(resumePath)
+		startSize = 0
+	}
+
+	total := size
+	if resuming && size >= 0 {
+		total += startSize
+	}
+	if !*started {
+		task.tracker.Start(task.url, total)
+		*started = true
+	}
+
+	// Every attempt, including retries, recounts from startSize: a
+	// resumed attempt already has that many bytes on disk, and a retry
+	// that had to restart from scratch must not keep whatever progress a
+	// prior, abandoned attempt credited past that point. Reset takes the
+	// absolute count directly, so unlike Write it needs no int64->int
+	// narrowing for files over 2GB.
+	task.tracker.Reset(startSize)
+
+	reader := io.Reader(&progressReader{Reader: body, tracker: task.tracker})
+
 	err = os.MkdirAll(filepath.Dir(task.destination), 0755)
 	if err != nil {
-		task.result <- err
-		return
+		return err
 	}
 
-	temppath := task.destination + ".down"
+	checksummer := NewChecksumWriter()
 
-	outfile, err := os.Create(temppath)
+	if resuming && task.expected.Size != -1 {
+		partial, err := os.Open(resumePath)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(checksummer, partial)
+		partial.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	// writePath is where bytes actually land for this attempt. Resuming
+	// keeps appending to resumePath, and a fresh download claims it too
+	// when resume is enabled, so that a download interrupted partway
+	// through leaves a partial file at the one predictable name a later
+	// run will look for. handleTask's in-flight tracking only serializes
+	// attempts within this process, so resumePath is claimed with O_EXCL:
+	// if some other process (or another aptly invocation entirely) already
+	// holds it, that create fails and this attempt falls back to its own
+	// O_EXCL-guaranteed unique file instead of racing a write against the
+	// shared name, trading its own resumability for correctness. With
+	// resume disabled entirely we always use the unique file.
+	var (
+		outfile   *os.File
+		writePath string
+	)
+
+	switch {
+	case resuming:
+		writePath = resumePath
+		outfile, err = os.OpenFile(resumePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	case downloader.options.DisableResume:
+		removeStaleParts(task.destination)
+		outfile, err = ioutil.TempFile(filepath.Dir(task.destination), filepath.Base(task.destination)+".*.part")
+		if outfile != nil {
+			writePath = outfile.Name()
+		}
+	default:
+		writePath = resumePath
+		outfile, err = os.OpenFile(resumePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			outfile, err = ioutil.TempFile(filepath.Dir(task.destination), filepath.Base(task.destination)+".*.part")
+			if outfile != nil {
+				writePath = outfile.Name()
+			}
+		}
+	}
 	if err != nil {
-		task.result <- err
-		return
+		return err
 	}
 	defer outfile.Close()
 
 	var w io.Writer
 
-	checksummer := NewChecksumWriter()
-
 	if task.expected.Size != -1 {
 		w = io.MultiWriter(outfile, checksummer)
 	} else {
 		w = outfile
 	}
 
-	_, err = io.Copy(w, resp.Body)
+	_, err = io.Copy(w, reader)
 	if err != nil {
-		os.Remove(temppath)
-		task.result <- err
-		return
+		// a partial at resumePath is kept so that a later attempt can resume it
+		if writePath != resumePath {
+			os.Remove(writePath)
+		}
+		return err
 	}
 
 	if task.expected.Size != -1 {
@@ -160,20 +781,21 @@ func (downloader *downloaderImpl) handleTask(task *downloadTask) {
 		}
 
 		if err != nil {
-			os.Remove(temppath)
-			task.result <- err
-			return
+			os.Remove(writePath)
+			if resuming {
+				return errCorruptResume
+			}
+			return err
 		}
 	}
 
-	err = os.Rename(temppath, task.destination)
+	err = os.Rename(writePath, task.destination)
 	if err != nil {
-		os.Remove(temppath)
-		task.result <- err
-		return
+		os.Remove(writePath)
+		return err
 	}
 
-	task.result <- nil
+	return nil
 }
 
 // process implements download thread in goroutine
@@ -219,28 +841,88 @@ func DownloadTemp(downloader Downloader, url string) (*os.File, error) {
 	return file, nil
 }
 
-// List of extensions + corresponding uncompression support
+// List of extensions + corresponding uncompression support, in the order
+// they should be tried: .zst, .xz, .bz2, .gz, .lzma, then the raw file.
 var compressionMethods = []struct {
 	extenstion     string
-	transformation func(io.Reader) (io.Reader, error)
+	transformation func(io.Reader) (io.ReadCloser, error)
 }{
 	{
-		extenstion:     ".bz2",
-		transformation: func(r io.Reader) (io.Reader, error) { return bzip2.NewReader(r), nil },
+		extenstion: ".zst",
+		transformation: func(r io.Reader) (io.ReadCloser, error) {
+			decoder, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return decoder.IOReadCloser(), nil
+		},
+	},
+	{
+		extenstion: ".xz",
+		transformation: func(r io.Reader) (io.ReadCloser, error) {
+			reader, err := xz.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.NopCloser(reader), nil
+		},
+	},
+	{
+		extenstion: ".bz2",
+		transformation: func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(bzip2.NewReader(r)), nil
+		},
 	},
 	{
-		extenstion:     ".gz",
-		transformation: func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		extenstion: ".gz",
+		transformation: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
 	},
 	{
-		extenstion:     "",
-		transformation: func(r io.Reader) (io.Reader, error) { return r, nil },
+		extenstion: ".lzma",
+		transformation: func(r io.Reader) (io.ReadCloser, error) {
+			reader, err := lzma.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.NopCloser(reader), nil
+		},
 	},
+	{
+		extenstion: "",
+		transformation: func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(r), nil
+		},
+	},
+}
+
+// multiCloser closes each of its closers in turn, returning the first error
+// encountered. Used to chain the decompressor's Close (which may release
+// goroutines or buffers, unlike bzip2.NewReader) with the backing file's.
+type multiCloser struct {
+	io.Reader
+	closers []io.Closer
 }
 
-// DownloadTryCompression tries to download from URL .bz2, .gz and raw extension until
-// it finds existing file.
-func DownloadTryCompression(downloader Downloader, url string) (io.Reader, *os.File, error) {
+func (c *multiCloser) Close() error {
+	var firstErr error
+
+	for _, closer := range c.closers {
+		if err := closer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// DownloadTryCompression tries to download from URL with .zst, .xz, .bz2, .gz,
+// .lzma and raw extensions, in that order, until it finds an existing file.
+//
+// The returned ReadCloser must be closed by the caller to release the
+// decompressor (and the underlying temp file) once done reading.
+func DownloadTryCompression(downloader Downloader, url string) (io.ReadCloser, *os.File, error) {
 	var err error
 
 	for _, method := range compressionMethods {
@@ -251,13 +933,14 @@ func DownloadTryCompression(downloader Downloader, url string) (io.Reader, *os.F
 			continue
 		}
 
-		var uncompressed io.Reader
+		var uncompressed io.ReadCloser
 		uncompressed, err = method.transformation(file)
 		if err != nil {
+			file.Close()
 			continue
 		}
 
-		return uncompressed, file, err
+		return &multiCloser{Reader: uncompressed, closers: []io.Closer{uncompressed, file}}, file, err
 	}
 	return nil, nil, err
 }